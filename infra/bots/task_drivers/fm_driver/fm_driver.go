@@ -7,14 +7,28 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	osexec "os/exec"
+	"path"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.etcd.io/bbolt"
 
 	"go.skia.org/infra/go/exec"
 	"go.skia.org/infra/go/util"
@@ -24,6 +38,184 @@ import (
 type work struct {
 	Sources []string
 	Flags   []string
+	GPU     bool
+}
+
+// resultsBucket is the single bbolt bucket --resultsDB records outcomes in.
+var resultsBucket = []byte("results")
+
+// historyLimit bounds how many past outcomes we keep per (fm, flags, source),
+// so --resultsDB doesn't grow unboundedly on long-running bots.
+const historyLimit = 20
+
+// outcome is one run of a single source, as stored in --resultsDB.
+type outcome struct {
+	Pass      bool          `json:"pass"`
+	Timeout   bool          `json:"timeout,omitempty"` // true if this outcome is a hang, not a crash
+	Duration  time.Duration `json:"duration"`
+	Stderr    string        `json:"stderr,omitempty"` // short digest of stderr, not the full text
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+// appendOutcome appends o to h, trimming to the most recent limit entries.
+func appendOutcome(h []outcome, o outcome, limit int) []outcome {
+	h = append(h, o)
+	if len(h) > limit {
+		h = h[len(h)-limit:]
+	}
+	return h
+}
+
+// flaky reports whether history contains both a pass and a failure.
+func flaky(history []outcome) bool {
+	sawPass, sawFail := false, false
+	for _, o := range history {
+		if o.Pass {
+			sawPass = true
+		} else {
+			sawFail = true
+		}
+	}
+	return sawPass && sawFail
+}
+
+// flagSummary is one flag-set's aggregate counts for --summary json.
+type flagSummary struct {
+	Pass    int `json:"pass"`
+	Fail    int `json:"fail"`
+	Timeout int `json:"timeout"` // subset of Fail that timed out, rather than crashed
+	Flaky   int `json:"flaky"`
+}
+
+// runTimeout runs name/args with output sent to stdout/stderr, enforcing a
+// deadline outside of go.skia.org/infra/go/exec (which has no hang-detection
+// hook of its own). On timeout it first sends SIGQUIT, which makes a Go
+// binary in the process chain (like fm itself) dump all goroutine stacks to
+// stderr before exiting -- invaluable for diagnosing a GPU driver deadlock --
+// then escalates to SIGKILL if it's still alive after quitGrace.
+//
+// This deliberately bypasses exec.Run()/exec.Command, which loses the
+// per-command Task Driver sub-step that query() still gets. That wrapper
+// only takes a context.Context deadline, and a context cancellation kills
+// the process outright -- there's no hook to send SIGQUIT first and wait out
+// quitGrace before SIGKILL, which is the whole point of this helper (a bare
+// SIGKILL never gives fm a chance to dump the goroutine stacks that make a
+// GPU driver hang diagnosable). Until go/exec grows a signal-escalation
+// option, the missing sub-step/logging for fm invocations themselves is an
+// accepted tradeoff; query()'s metadata calls are unaffected and keep using
+// the wrapper.
+func runTimeout(name string, args []string, stdout, stderr io.Writer, timeout, quitGrace time.Duration) (timedOut bool, err error) {
+	cmd := osexec.Command(name, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return false, err
+	case <-time.After(timeout):
+	}
+
+	timedOut = true
+	_ = cmd.Process.Signal(syscall.SIGQUIT)
+	select {
+	case err = <-done:
+		if err == nil {
+			// Exiting cleanly after SIGQUIT still counts as a timeout failure.
+			err = fmt.Errorf("%s timed out after %v", name, timeout)
+		}
+		return timedOut, err
+	case <-time.After(quitGrace):
+	}
+
+	_ = cmd.Process.Kill()
+	err = <-done
+	return timedOut, err
+}
+
+// canonicalizeFlags turns ["-b", "cpu", "-ct", "8888"] into "-b=cpu -ct=8888",
+// sorted so the same flag set always hashes to the same resultsDB key
+// regardless of the order it appears in a job.
+func canonicalizeFlags(flags []string) string {
+	pairs := []string{}
+	for i := 0; i+1 < len(flags); i += 2 {
+		pairs = append(pairs, flags[i]+"="+flags[i+1])
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// matchSources resolves a non-flag job token into the names it refers to: an
+// explicit "match:<glob>" pattern, an exact name (if exact is set), or (the
+// default) a substring match against every name in sources. An empty, non-nil
+// result means the token was well-formed but matched nothing.
+func matchSources(token string, sources []string, exact bool) ([]string, error) {
+	matches := []string{}
+	if glob := strings.TrimPrefix(token, "match:"); glob != token {
+		for _, source := range sources {
+			ok, err := path.Match(glob, source)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matches = append(matches, source)
+			}
+		}
+	} else if exact {
+		for _, source := range sources {
+			if source == token {
+				matches = append(matches, source)
+			}
+		}
+	} else {
+		for _, source := range sources {
+			if strings.Contains(source, token) {
+				matches = append(matches, source)
+			}
+		}
+	}
+	return matches, nil
+}
+
+// shardMember reports whether source (under the given canonicalized flags)
+// is assigned to shard shardIndex of shardCount, via a deterministic
+// FNV-1a hash so the same (flags, source) always lands in the same shard.
+func shardMember(flagsKey, source string, shardIndex, shardCount int) bool {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(flagsKey + "\x00" + source))
+	return int(h.Sum64()%uint64(shardCount)) == shardIndex
+}
+
+// includeByMode reports whether a source with the given history should run
+// under --mode=failing or --mode=flaky. mode must not be "all".
+func includeByMode(mode string, history []outcome) bool {
+	switch mode {
+	case "failing":
+		return len(history) > 0 && !history[len(history)-1].Pass
+	case "flaky":
+		return flaky(history)
+	}
+	return false
+}
+
+// cpuBackends lists the `b=` backend values that run on the CPU and so belong
+// on the CPU worker pool. Anything else (gl, vk, mtl, ...) is assumed to need
+// a GPU.
+var cpuBackends = map[string]bool{
+	"cpu":  true,
+	"skvm": true,
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
 
 func main() {
@@ -35,10 +227,61 @@ func main() {
 		local     = flag.Bool("local", true, "Running locally (else on the bots)?")
 
 		resources = flag.String("resources", "resources", "Passed to fm -i.")
+
+		cpuLimit = flag.Int("cpuLimit", runtime.NumCPU(), "Number of concurrent CPU-bound fm invocations.")
+		gpuLimit = flag.Int("gpuLimit", minInt(8, runtime.NumCPU()), "Number of concurrent GPU-bound fm invocations. Kept low to avoid GPU driver hangs from oversubscription.")
+
+		scriptPath = flag.String("script", "", "Path to a file listing jobs to run, one per line. Pass - to read from stdin.")
+		exact      = flag.Bool("exact", false, "Require non-flag job tokens to exactly match a GM or test name, rather than matching as a substring.")
+
+		resultsDB = flag.String("resultsDB", "", "Path to a bbolt database recording per-source pass/fail history, keyed by (fm binary, flags, source). Required for --mode=failing/flaky.")
+		mode      = flag.String("mode", "all", "Which sources to run: all, failing (most recent run for that source failed), or flaky (mixed pass/fail history).")
+		summary   = flag.String("summary", "", "If 'json', print an aggregate pass/fail/flake summary per flag set to stdout when done.")
+
+		timeout       = flag.Duration("timeout", 5*time.Minute, "Timeout for a batch fm invocation. A hung invocation is killed and treated as a failure.")
+		singleTimeout = flag.Duration("singleTimeout", 2*time.Minute, "Timeout for an fm invocation running a single source, including single-source retries.")
+		quitGrace     = flag.Duration("quitGrace", 10*time.Second, "Grace period after SIGQUIT before SIGKILLing a timed-out fm invocation.")
+
+		shard = flag.String("shard", "", "i/n: run only the sources assigned to shard i (0-indexed) of n, for splitting a job across multiple machines.")
+		seed  = flag.Int64("seed", 1, "Seed for intra-shard batch shuffling. Fixed by default so shards stay stable across retries.")
 	)
 	ctx := td.StartRun(projectId, taskId, taskName, output, local)
 	defer td.EndRun(ctx)
 
+	if *cpuLimit < 1 || *gpuLimit < 1 {
+		td.Fatalf(ctx, "--cpuLimit and --gpuLimit must each be at least 1; got %d, %d", *cpuLimit, *gpuLimit)
+	}
+	if *mode != "all" && *mode != "failing" && *mode != "flaky" {
+		td.Fatalf(ctx, "--mode must be one of all, failing, flaky; got %q", *mode)
+	}
+	if *mode != "all" && *resultsDB == "" {
+		td.Fatalf(ctx, "--mode=%s requires --resultsDB", *mode)
+	}
+	if *summary != "" && *summary != "json" {
+		td.Fatalf(ctx, "--summary only supports json; got %q", *summary)
+	}
+
+	shardIndex, shardCount := 0, 1
+	if *shard != "" {
+		parts := strings.SplitN(*shard, "/", 2)
+		var err error
+		if len(parts) != 2 {
+			td.Fatalf(ctx, "--shard must be of the form i/n; got %q", *shard)
+		}
+		if shardIndex, err = strconv.Atoi(parts[0]); err != nil {
+			td.Fatalf(ctx, "--shard must be of the form i/n; got %q", *shard)
+		}
+		if shardCount, err = strconv.Atoi(parts[1]); err != nil {
+			td.Fatalf(ctx, "--shard must be of the form i/n; got %q", *shard)
+		}
+		if shardCount < 1 || shardIndex < 0 || shardIndex >= shardCount {
+			td.Fatalf(ctx, "--shard %q must have 0 <= i < n", *shard)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(*seed))
+
+	actualStdout := os.Stdout
 	actualStderr := os.Stderr
 	if *local {
 		// Task Driver echoes every exec.Run() stdout and stderr to the console,
@@ -56,6 +299,117 @@ func main() {
 	}
 	fm := flag.Arg(0)
 
+	var db *bbolt.DB
+	if *resultsDB != "" {
+		var err error
+		db, err = bbolt.Open(*resultsDB, 0644, nil)
+		if err != nil {
+			td.Fatal(ctx, err)
+		}
+		defer db.Close()
+		if err := db.Update(func(tx *bbolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(resultsBucket)
+			return err
+		}); err != nil {
+			td.Fatal(ctx, err)
+		}
+	}
+
+	// fmHash identifies this exact fm binary in resultsDB keys, so results
+	// don't get mixed up with runs of a differently-built fm. Only computed
+	// when a resultsDB is actually open: fm can be hundreds of MB, and
+	// --mode=all with no --resultsDB (the common case) never consults it.
+	fmHash := ""
+	if db != nil {
+		b, err := ioutil.ReadFile(fm)
+		if err != nil {
+			td.Fatal(ctx, err)
+		}
+		sum := sha256.Sum256(b)
+		fmHash = hex.EncodeToString(sum[:])
+	}
+
+	// history looks up the recorded outcomes for one (flags, source) pair.
+	history := func(flagsKey, source string) []outcome {
+		if db == nil {
+			return nil
+		}
+		var h []outcome
+		if err := db.View(func(tx *bbolt.Tx) error {
+			v := tx.Bucket(resultsBucket).Get([]byte(fmHash + "\x00" + flagsKey + "\x00" + source))
+			if v == nil {
+				return nil
+			}
+			return json.Unmarshal(v, &h)
+		}); err != nil {
+			td.Fatal(ctx, err)
+		}
+		return h
+	}
+
+	summaryMu := sync.Mutex{}
+	summaries := map[string]*flagSummary{}
+	summaryFor := func(flagsKey string) *flagSummary {
+		summaryMu.Lock()
+		defer summaryMu.Unlock()
+		fs := summaries[flagsKey]
+		if fs == nil {
+			fs = &flagSummary{}
+			summaries[flagsKey] = fs
+		}
+		return fs
+	}
+
+	// record upserts the outcome of one finished batch (all Sources sharing a
+	// single pass/fail result) in a single write transaction, to bound fsync
+	// cost when running many small batches.
+	record := func(sources []string, flagsKey string, pass, timedOut bool, dur time.Duration, stderrDigest string) {
+		fs := summaryFor(flagsKey)
+		summaryMu.Lock()
+		if pass {
+			fs.Pass += len(sources)
+		} else {
+			fs.Fail += len(sources)
+			if timedOut {
+				fs.Timeout += len(sources)
+			}
+		}
+		summaryMu.Unlock()
+
+		if db == nil {
+			return
+		}
+		now := time.Now()
+		if err := db.Update(func(tx *bbolt.Tx) error {
+			b := tx.Bucket(resultsBucket)
+			for _, source := range sources {
+				key := []byte(fmHash + "\x00" + flagsKey + "\x00" + source)
+				var h []outcome
+				if v := b.Get(key); v != nil {
+					if err := json.Unmarshal(v, &h); err != nil {
+						return err
+					}
+				}
+				h = appendOutcome(h, outcome{Pass: pass, Timeout: timedOut, Duration: dur, Stderr: stderrDigest, Timestamp: now}, historyLimit)
+				if flaky(h) {
+					summaryMu.Lock()
+					fs.Flaky++
+					summaryMu.Unlock()
+				}
+				data, err := json.Marshal(h)
+				if err != nil {
+					return err
+				}
+				if err := b.Put(key, data); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			td.Fatal(ctx, err)
+		}
+	}
+
 	// Run `fm <flag>` to find the names of all linked GMs or tests.
 	query := func(flag string) []string {
 		stdout := &bytes.Buffer{}
@@ -78,6 +432,20 @@ func main() {
 	}
 	gms := query("--listGMs")
 	tests := query("--listTests")
+	allSources := append(append([]string{}, gms...), tests...)
+
+	// match resolves a non-flag job token into the Sources it refers to,
+	// fatal'ing out if the token is an invalid glob or matches nothing.
+	match := func(token string) []string {
+		matches, err := matchSources(token, allSources, *exact)
+		if err != nil {
+			td.Fatal(ctx, err)
+		}
+		if len(matches) == 0 {
+			td.Fatalf(ctx, "pattern %q matched no GMs or tests", token)
+		}
+		return matches
+	}
 
 	// Parse a job like "gms b=cpu ct=8888" into a struct of Sources to run under given Flags.
 	parse := func(job []string) *work {
@@ -109,28 +477,36 @@ func main() {
 				f += parts[0]
 
 				w.Flags = append(w.Flags, f, parts[1])
+				if parts[0] == "b" && !cpuBackends[parts[1]] {
+					w.GPU = true
+				}
 				continue
 			}
 
-			// Anything else must be the name of a source for FM to run.
-			w.Sources = append(w.Sources, token)
+			// Anything else is a pattern to match against the known GMs and tests.
+			w.Sources = append(w.Sources, match(token)...)
 		}
 
 		return w
 	}
 
-	// TODO: this doesn't have to be hard coded, of course.
-	// TODO: add some .skps or images to demo that.
-	script := `
-	b=cpu tests
-	b=cpu gms
-	b=cpu gms skvm=true
+	if *scriptPath == "" {
+		td.Fatalf(ctx, "Please pass --script.")
+	}
+	var scriptReader io.Reader
+	if *scriptPath == "-" {
+		scriptReader = os.Stdin
+	} else {
+		f, err := os.Open(*scriptPath)
+		if err != nil {
+			td.Fatal(ctx, err)
+		}
+		defer f.Close()
+		scriptReader = f
+	}
 
-	#b=cpu gms skvm=true gamut=p3
-	#b=cpu gms skvm=true ct=565
-	`
 	jobs := [][]string{}
-	scanner := bufio.NewScanner(strings.NewReader(script))
+	scanner := bufio.NewScanner(scriptReader)
 	for scanner.Scan() {
 		jobs = append(jobs, strings.Fields(scanner.Text()))
 	}
@@ -140,24 +516,44 @@ func main() {
 
 	// We'll kick off workers to run FM with `-s <Sources...> <Flags...>` from parsed jobs.
 	var failures int32 = 0
+	var hangs int32 = 0
 	wg := &sync.WaitGroup{}
 
 	worker := func(queue chan work) {
 		for w := range queue {
+			flagsKey := canonicalizeFlags(w.Flags)
+			args := []string{"-i", *resources, "-s"}
+			args = append(args, w.Sources...)
+			args = append(args, w.Flags...)
+
+			to := *timeout
+			if len(w.Sources) == 1 {
+				to = *singleTimeout
+			}
+
 			stdout := &bytes.Buffer{}
 			stderr := &bytes.Buffer{}
-			cmd := &exec.Command{Name: fm, Stdout: stdout, Stderr: stderr}
-			cmd.Args = append(cmd.Args, "-i", *resources)
-			cmd.Args = append(cmd.Args, "-s")
-			cmd.Args = append(cmd.Args, w.Sources...)
-			cmd.Args = append(cmd.Args, w.Flags...)
-			if err := exec.Run(ctx, cmd); err != nil {
+			start := time.Now()
+			timedOut, err := runTimeout(fm, args, stdout, stderr, to, *quitGrace)
+			dur := time.Since(start)
+			if err != nil {
 				// We optimistically run batches of Sources, but if a batch fails,
 				// we'll re-run one at a time to find the precise failures.
 				if len(w.Sources) == 1 {
 					// If a source ran alone and failed, that's just a failure.
 					atomic.AddInt32(&failures, 1)
+					if timedOut {
+						atomic.AddInt32(&hangs, 1)
+					}
 					td.FailStep(ctx, err)
+
+					stderrDigest := ""
+					if stderr.Len() > 0 {
+						sum := sha256.Sum256(stderr.Bytes())
+						stderrDigest = hex.EncodeToString(sum[:8])
+					}
+					record(w.Sources, flagsKey, false, timedOut, dur, stderrDigest)
+
 					if *local {
 						lines := []string{}
 						scanner := bufio.NewScanner(stderr)
@@ -168,60 +564,121 @@ func main() {
 							td.Fatal(ctx, err)
 						}
 
-						fmt.Fprintf(actualStderr, "%v %v #failed:\n\t%v\n",
-							cmd.Name,
-							strings.Join(cmd.Args, " "),
+						tag := "failed"
+						if timedOut {
+							tag = "timed out"
+						}
+						fmt.Fprintf(actualStderr, "%v -i %v -s %v %v #%v:\n\t%v\n",
+							fm, *resources, strings.Join(w.Sources, " "), strings.Join(w.Flags, " "), tag,
 							strings.Join(lines, "\n\t"))
 					}
 				} else {
-					// If a batch fails, retry each individually.
+					// If a batch fails (including a batch-wide hang), retry each
+					// individually to find the precise failures.
 					for _, source := range w.Sources {
 						// Requeuing work from the workers makes sizing the chan buffer tricky:
 						// we don't ever want this `queue <-` to block on a full buffer.
+						// Re-queue to this same queue so single-source retries stay on
+						// whichever pool (CPU or GPU) their parent batch was running on.
 						wg.Add(1)
-						queue <- work{[]string{source}, w.Flags}
+						queue <- work{[]string{source}, w.Flags, w.GPU}
 					}
 				}
+			} else {
+				record(w.Sources, flagsKey, true, false, dur, "")
 			}
 			wg.Done()
 		}
 	}
 
-	workers := runtime.NumCPU()
-	queue := make(chan work, 1<<20) // Huge buffer to avoid having to be smart about requeuing.
-	for i := 0; i < workers; i++ {
-		go worker(queue)
+	// Two separate pools: GPU-bound jobs (b=gl, b=vk, b=mtl, ...) are capped
+	// low to avoid oversubscribing the GPU, while CPU-bound jobs (b=cpu,
+	// b=skvm) can use the whole machine.
+	cpuQueue := make(chan work, 1<<20) // Huge buffer to avoid having to be smart about requeuing.
+	gpuQueue := make(chan work, 1<<20)
+	for i := 0; i < *cpuLimit; i++ {
+		go worker(cpuQueue)
+	}
+	for i := 0; i < *gpuLimit; i++ {
+		go worker(gpuQueue)
 	}
 
+	shardSourceCount := 0
 	for _, job := range jobs {
 		w := parse(job)
 		if len(w.Sources) == 0 {
 			continue // A blank/commented line in the job script.
 		}
 
+		if shardCount > 1 {
+			flagsKey := canonicalizeFlags(w.Flags)
+			filtered := w.Sources[:0]
+			for _, source := range w.Sources {
+				if shardMember(flagsKey, source, shardIndex, shardCount) {
+					filtered = append(filtered, source)
+				}
+			}
+			w.Sources = filtered
+			if len(w.Sources) == 0 {
+				continue
+			}
+		}
+
+		if *mode != "all" {
+			flagsKey := canonicalizeFlags(w.Flags)
+			filtered := w.Sources[:0]
+			for _, source := range w.Sources {
+				if includeByMode(*mode, history(flagsKey, source)) {
+					filtered = append(filtered, source)
+				}
+			}
+			w.Sources = filtered
+			if len(w.Sources) == 0 {
+				continue
+			}
+		}
+
 		// Shuffle the sources randomly as a cheap way to approximate evenly expensive batches.
-		// (Intentionally not rand.Seed()'d to stay deterministically reproducible.)
-		rand.Shuffle(len(w.Sources), func(i, j int) {
+		// Seeded from --seed (fixed by default) to stay deterministically reproducible.
+		rng.Shuffle(len(w.Sources), func(i, j int) {
 			w.Sources[i], w.Sources[j] = w.Sources[j], w.Sources[i]
 		})
+		shardSourceCount += len(w.Sources)
+
+		queue, workers := cpuQueue, *cpuLimit
+		if w.GPU {
+			queue, workers = gpuQueue, *gpuLimit
+		}
 
 		// Round batch sizes up so there's at least one source per batch.
 		batch := (len(w.Sources) + workers - 1) / workers
 		util.ChunkIter(len(w.Sources), batch, func(start, end int) error {
 			wg.Add(1)
-			queue <- work{w.Sources[start:end], w.Flags}
+			queue <- work{w.Sources[start:end], w.Flags, w.GPU}
 			return nil
 		})
 	}
+	td.Log(ctx, "shard", fmt.Sprintf("shard %d/%d assigned %d sources, seed=%d\n", shardIndex, shardCount, shardSourceCount, *seed))
 	wg.Wait()
 
+	if *summary == "json" {
+		summaryMu.Lock()
+		data, err := json.MarshalIndent(summaries, "", "  ")
+		summaryMu.Unlock()
+		if err != nil {
+			td.Fatal(ctx, err)
+		}
+		fmt.Fprintln(actualStdout, string(data))
+	}
+
 	if failures > 0 {
+		msg := fmt.Sprintf("%v runs of %v failed after retries (%v of which timed out).", failures, fm, hangs)
 		if *local {
 			// td.Fatalf() would work fine, but barfs up a panic that we don't need to see.
-			fmt.Fprintf(actualStderr, "%v runs of %v failed after retries.\n", failures, fm)
+			fmt.Fprintln(actualStderr, msg)
 			os.Exit(1)
 		} else {
-			td.Fatalf(ctx, "%v runs of %v failed after retries.", failures, fm)
+			td.Fatalf(ctx, "%s", msg)
 		}
 	}
 }
@@ -0,0 +1,147 @@
+// Copyright 2020 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCanonicalizeFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		want  string
+	}{
+		{"empty", nil, ""},
+		{"single pair", []string{"-b", "cpu"}, "-b=cpu"},
+		{"sorted regardless of input order", []string{"-ct", "8888", "-b", "cpu"}, "-b=cpu -ct=8888"},
+		{"same set, different order, same key", []string{"-b", "cpu", "-ct", "8888"}, "-b=cpu -ct=8888"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := canonicalizeFlags(tc.flags); got != tc.want {
+				t.Errorf("canonicalizeFlags(%v) = %q, want %q", tc.flags, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFlaky(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []outcome
+		want    bool
+	}{
+		{"empty", nil, false},
+		{"all pass", []outcome{{Pass: true}, {Pass: true}}, false},
+		{"all fail", []outcome{{Pass: false}, {Pass: false}}, false},
+		{"mixed", []outcome{{Pass: true}, {Pass: false}}, true},
+		{"mixed, fail then pass", []outcome{{Pass: false}, {Pass: true}}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := flaky(tc.history); got != tc.want {
+				t.Errorf("flaky(%v) = %v, want %v", tc.history, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMatchSources(t *testing.T) {
+	sources := []string{"gmA", "gmB", "gmTricky", "testA"}
+	tests := []struct {
+		name  string
+		token string
+		exact bool
+		want  []string
+	}{
+		{"substring default", "gm", false, []string{"gmA", "gmB", "gmTricky"}},
+		{"substring matches none", "nope", false, []string{}},
+		{"exact match", "gmA", true, []string{"gmA"}},
+		{"exact match, substring would have matched more", "gm", true, []string{}},
+		{"glob", "match:gm?", false, []string{"gmA", "gmB"}},
+		{"glob matches none", "match:zzz*", false, []string{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := matchSources(tc.token, sources, tc.exact)
+			if err != nil {
+				t.Fatalf("matchSources(%q) returned error: %v", tc.token, err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("matchSources(%q) = %v, want %v", tc.token, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMatchSourcesInvalidGlob(t *testing.T) {
+	if _, err := matchSources("match:[", []string{"gmA"}, false); err == nil {
+		t.Fatal("matchSources with a malformed glob should return an error")
+	}
+}
+
+func TestShardMember(t *testing.T) {
+	const shardCount = 4
+	counts := make([]int, shardCount)
+	seen := map[string]int{}
+	for i := 0; i < 100; i++ {
+		source := "source" + string(rune('A'+i%26)) + string(rune('0'+i/26))
+		for shardIndex := 0; shardIndex < shardCount; shardIndex++ {
+			if shardMember("-b=cpu", source, shardIndex, shardCount) {
+				counts[shardIndex]++
+				seen[source]++
+			}
+		}
+	}
+	for source, n := range seen {
+		if n != 1 {
+			t.Errorf("source %q was assigned to %d shards, want exactly 1", source, n)
+		}
+	}
+	if shardMember("-b=cpu", "same-source", 0, shardCount) != shardMember("-b=cpu", "same-source", 0, shardCount) {
+		t.Error("shardMember is not deterministic for the same inputs")
+	}
+}
+
+func TestIncludeByMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		history []outcome
+		want    bool
+	}{
+		{"failing, no history", "failing", nil, false},
+		{"failing, last run passed", "failing", []outcome{{Pass: false}, {Pass: true}}, false},
+		{"failing, last run failed", "failing", []outcome{{Pass: true}, {Pass: false}}, true},
+		{"flaky, consistent pass", "flaky", []outcome{{Pass: true}, {Pass: true}}, false},
+		{"flaky, mixed", "flaky", []outcome{{Pass: true}, {Pass: false}}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := includeByMode(tc.mode, tc.history); got != tc.want {
+				t.Errorf("includeByMode(%q, %v) = %v, want %v", tc.mode, tc.history, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAppendOutcomeTrimsToLimit(t *testing.T) {
+	var h []outcome
+	for i := 0; i < 5; i++ {
+		h = appendOutcome(h, outcome{Pass: i%2 == 0, Timestamp: time.Unix(int64(i), 0)}, 3)
+	}
+	if len(h) != 3 {
+		t.Fatalf("len(h) = %d, want 3", len(h))
+	}
+	// The oldest two entries (i=0, i=1) should have been dropped, keeping i=2,3,4.
+	for i, wantPass := range []bool{true, false, true} {
+		if h[i].Pass != wantPass {
+			t.Errorf("h[%d].Pass = %v, want %v", i, h[i].Pass, wantPass)
+		}
+	}
+}